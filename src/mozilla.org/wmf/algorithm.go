@@ -0,0 +1,48 @@
+package wmf
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// hawkAlgorithms maps the "algorithm=" header value to the hash
+// constructor Hawk signs and hashes with. sha256 remains the default for
+// callers that never set Algorithm, so existing headers keep verifying.
+var hawkAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// hashFunc resolves self.Algorithm to a hash constructor, falling back to
+// sha256 for an empty or unrecognized value rather than erroring -- an
+// unknown algorithm should fail signature comparison, not panic here.
+func (self *Hawk) hashFunc() func() hash.Hash {
+	if fn, ok := hawkAlgorithms[self.Algorithm]; ok {
+		return fn
+	}
+	return sha256.New
+}
+
+// macKey returns the key to pass to hmac.New. By default that's just the
+// raw shared secret, same as always. When DeriveKey is set, it instead
+// derives a one-time subkey from secret via HKDF-SHA256, salted with this
+// request's (ts, nonce) and bound to the method and path via the info
+// parameter -- so a leaked subkey only ever covers the single request it
+// was derived for, and the long-lived secret never signs a request header
+// mac directly. Bewits, Server-Authorization headers and tsm challenges
+// are still keyed by the raw secret.
+func (self *Hawk) macKey(secret string) []byte {
+	if !self.DeriveKey {
+		return []byte(secret)
+	}
+	salt := []byte(self.Time + self.Nonce)
+	info := []byte("hawk.1.header" + self.Method + self.Path)
+	r := hkdf.New(sha256.New, []byte(secret), salt, info)
+	key := make([]byte, 32)
+	io.ReadFull(r, key)
+	return key
+}
@@ -0,0 +1,204 @@
+package wmf
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+var ErrInvalidWebhookSignature = errors.New("Invalid webhook signature")
+var ErrNoSigningKey = errors.New("AsymSigner has no signing key")
+
+const pemPrivateKeyType = "ED25519 PRIVATE KEY"
+
+// AsymKey is one Ed25519 keypair known to an AsymSigner. Private is nil
+// for a key loaded only to verify (e.g. a peer's), not to sign with.
+type AsymKey struct {
+	ID      string
+	Public  ed25519.PublicKey
+	Private ed25519.PrivateKey
+}
+
+// keyID derives a short, stable identifier for a public key, used as the
+// JWKS "kid" so a verifier can tell keys apart without caring about
+// rotation order.
+func keyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// GenerateAsymKey creates a fresh Ed25519 keypair.
+func GenerateAsymKey() (*AsymKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &AsymKey{ID: keyID(pub), Public: pub, Private: priv}, nil
+}
+
+// SaveAsymKeyPEM writes key's private key to path as a PEM block. The
+// public key isn't stored separately -- it's the last 32 bytes of the
+// Ed25519 private key, so LoadAsymKeyPEM recovers both from one file.
+func SaveAsymKeyPEM(key *AsymKey, path string) error {
+	block := &pem.Block{Type: pemPrivateKeyType, Bytes: []byte(key.Private)}
+	return ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600)
+}
+
+// LoadAsymKeyPEM reads a private key PEM written by SaveAsymKeyPEM.
+func LoadAsymKeyPEM(path string) (*AsymKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pemPrivateKeyType || len(block.Bytes) != ed25519.PrivateKeySize {
+		return nil, errors.New("not an Ed25519 private key PEM")
+	}
+	priv := ed25519.PrivateKey(block.Bytes)
+	pub := make([]byte, ed25519.PublicKeySize)
+	copy(pub, priv[ed25519.PublicKeySize:])
+	return &AsymKey{ID: keyID(pub), Public: pub, Private: priv}, nil
+}
+
+// AsymSigner signs outbound webhook bodies with Ed25519 and verifies
+// inbound ones, so receivers don't need a pre-shared HMAC secret -- they
+// only need the sender's public key(s), published via PublicKeysHandler.
+// It supports key rotation: Sign always uses the newest key added, while
+// Verify accepts a signature from any key still held, so a receiver that
+// hasn't refetched the JWKS yet can still verify requests signed just
+// before a rotation.
+type AsymSigner struct {
+	mu   sync.RWMutex
+	keys []*AsymKey // oldest..newest; keys[len-1] signs
+}
+
+// NewAsymSigner returns an AsymSigner seeded with keys, newest last.
+func NewAsymSigner(keys ...*AsymKey) *AsymSigner {
+	return &AsymSigner{keys: keys}
+}
+
+// AddKey adds key as the newest key, so it becomes the one Sign uses.
+func (self *AsymSigner) AddKey(key *AsymKey) {
+	self.mu.Lock()
+	self.keys = append(self.keys, key)
+	self.mu.Unlock()
+}
+
+// RotateKey generates a new key, adds it as the newest, and returns it so
+// the caller can persist it (e.g. via SaveAsymKeyPEM).
+func (self *AsymSigner) RotateKey() (*AsymKey, error) {
+	key, err := GenerateAsymKey()
+	if err != nil {
+		return nil, err
+	}
+	self.AddKey(key)
+	return key, nil
+}
+
+func (self *AsymSigner) newestKey() *AsymKey {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.keys) == 0 {
+		return nil
+	}
+	return self.keys[len(self.keys)-1]
+}
+
+func bodyDigestHex(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign returns the "X-WMF-Signature" header value for body: "t=<unix>,
+// v1=<base64 sig>", where the signature covers "<t>.<hex sha256(body)>".
+func (self *AsymSigner) Sign(body []byte) (string, error) {
+	key := self.newestKey()
+	if key == nil || key.Private == nil {
+		return "", ErrNoSigningKey
+	}
+	ts := time.Now().Unix()
+	msg := fmt.Sprintf("%d.%s", ts, bodyDigestHex(body))
+	sig := ed25519.Sign(key.Private, []byte(msg))
+	return fmt.Sprintf("t=%d, v1=%s", ts, base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+// Verify checks header (as produced by Sign) against body, trying every
+// key this signer currently holds. It returns ErrInvalidWebhookSignature
+// if none match.
+func (self *AsymSigner) Verify(body []byte, header string) error {
+	var ts, sigB64 string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			sigB64 = kv[1]
+		}
+	}
+	if ts == "" || sigB64 == "" {
+		return ErrInvalidWebhookSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(sigB64)
+	if err != nil {
+		return ErrInvalidWebhookSignature
+	}
+	msg := []byte(ts + "." + bodyDigestHex(body))
+
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	for _, key := range self.keys {
+		if ed25519.Verify(key.Public, msg, sig) {
+			return nil
+		}
+	}
+	return ErrInvalidWebhookSignature
+}
+
+// jwk is the subset of RFC 7517 this package needs to publish an Ed25519
+// (RFC 8037 "OKP"/"Ed25519") public key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// PublicKeysHandler serves every key this signer holds (active and still
+// being verified against, i.e. not yet retired) as a JWKS document, for
+// mounting at a path like "/keys/public".
+func (self *AsymSigner) PublicKeysHandler(w http.ResponseWriter, req *http.Request) {
+	self.mu.RLock()
+	set := jwkSet{Keys: make([]jwk, 0, len(self.keys))}
+	for _, key := range self.keys {
+		set.Keys = append(set.Keys, jwk{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(key.Public),
+			Kid: key.ID,
+		})
+	}
+	self.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(set)
+}
@@ -0,0 +1,128 @@
+package wmf
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidBewit = errors.New("Invalid bewit")
+var ErrExpiredBewit = errors.New("Bewit has expired")
+
+// GenerateBewit builds a "bewit=" query token for req, good for ttl from
+// now, following the Hawk bewit extension: base64 of "id\exp\mac\ext".
+// The mac uses the same normalized string layout as a header mac, but
+// with the "hawk.1.bewit" tag, the expiry as the timestamp, GET as the
+// method, and an empty nonce and payload hash; it is keyed by the raw
+// secret even when DeriveKey is set. A bewit is not single-use:
+// ValidateBewit accepts the same token any number of times until it
+// expires. self.Id must already be set.
+func (self *Hawk) GenerateBewit(req *http.Request, ttl time.Duration, ext, secret string) (bewit string, err error) {
+	if self.Id == "" {
+		return "", errors.New("Hawk.Id must be set before generating a bewit")
+	}
+	path := getFullPath(req)
+	host, port := self.getHostPort(req)
+	exp := strconv.FormatInt(time.Now().UTC().Add(ttl).Unix(), 10)
+
+	marshalStr := macNormalizedString("hawk.1.bewit", exp, "", "GET",
+		path, strings.ToLower(host), port, "", ext)
+	mac := hmac.New(self.hashFunc(), []byte(secret))
+	mac.Write([]byte(marshalStr))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	token := strings.Join([]string{self.Id, exp, sig, ext}, "\\")
+	return base64.URLEncoding.EncodeToString([]byte(token)), nil
+}
+
+// stripQueryParam removes key from a raw, still-encoded query string,
+// preserving the order and exact encoding of the remaining parameters.
+// Reparsing via url.Values and re-Encode()ing instead would sort by key
+// and re-escape every value, producing a different string than the one
+// getFullPath(req) signed whenever the URL carries other query params.
+func stripQueryParam(rawQuery, key string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	var kept []string
+	for _, part := range strings.Split(rawQuery, "&") {
+		name := part
+		if i := strings.IndexByte(part, '='); i >= 0 {
+			name = part[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if name == key {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, "&")
+}
+
+// ParseBewit reads the "bewit" query parameter off req into self (Id,
+// Time, Signature, Extra) and strips it from the URL before path/mac
+// comparisons, as the bewit spec requires -- the bewit itself isn't part
+// of what got signed. It does not verify the mac; call ValidateBewit (with
+// the matching secret) for that.
+func (self *Hawk) ParseBewit(req *http.Request) (err error) {
+	raw := req.URL.Query().Get("bewit")
+	if raw == "" {
+		return ErrInvalidBewit
+	}
+	decoded, err := base64.URLEncoding.DecodeString(raw)
+	if err != nil {
+		return ErrInvalidBewit
+	}
+	parts := strings.SplitN(string(decoded), "\\", 4)
+	if len(parts) != 4 {
+		return ErrInvalidBewit
+	}
+	self.Id, self.Time, self.Signature, self.Extra = parts[0], parts[1], parts[2], parts[3]
+	self.Method = "GET"
+	self.Nonce = ""
+	self.Hash = ""
+
+	// Strip "bewit" the same way GenerateBewit's caller added it -- as one
+	// more query param on an otherwise untouched raw query -- so the signed
+	// path matches exactly, including the order and encoding of any other
+	// params, instead of the alphabetized, re-escaped string url.Values
+	// would produce.
+	strippedUrl := *req.URL
+	strippedUrl.RawQuery = stripQueryParam(req.URL.RawQuery, "bewit")
+	self.Path = strippedUrl.Path
+	if len(strippedUrl.RawQuery) > 0 {
+		self.Path = self.Path + "?" + strippedUrl.RawQuery
+	}
+	self.Host, self.Port = self.getHostPort(req)
+	return nil
+}
+
+// ValidateBewit checks a ParseBewit'd request's expiry and mac against
+// secret, returning ErrExpiredBewit or ErrInvalidSignature as appropriate.
+func (self *Hawk) ValidateBewit(secret string) error {
+	exp, err := strconv.ParseInt(self.Time, 10, 64)
+	if err != nil {
+		return ErrInvalidBewit
+	}
+	if time.Now().UTC().Unix() > exp {
+		return ErrExpiredBewit
+	}
+
+	marshalStr := macNormalizedString("hawk.1.bewit", self.Time, "", "GET",
+		self.Path, strings.ToLower(self.Host), self.Port, "", self.Extra)
+	mac := hmac.New(self.hashFunc(), []byte(secret))
+	mac.Write([]byte(marshalStr))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	if !self.Compare(expected) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package wmf
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClockSkew tracks the offset between our clock and a Hawk server's,
+// learned from the "tsm=" field a 401 challenge sends back (an HMAC of the
+// server's own timestamp, so a man-in-the-middle can't feed us an
+// arbitrary clock skew without knowing the shared secret). Once recorded,
+// subsequent requests sign with the compensated time instead of the local
+// clock, the same role SNTP plays for wall-clock time.
+type ClockSkew struct {
+	mu     sync.RWMutex
+	offset time.Duration
+}
+
+// ParseTimestampChallenge reads "ts" and "tsm" off a 401 response's
+// WWW-Authenticate header, verifies tsm (HMAC-SHA256 of ts, keyed by
+// secret) and, if valid, records the resulting offset.
+func (self *ClockSkew) ParseTimestampChallenge(header, secret string) error {
+	if len(header) < 5 || strings.ToLower(header[:4]) != "hawk" {
+		return ErrNotHawkAuth
+	}
+	var ts, tsm string
+	for _, element := range strings.Split(header[5:], ", ") {
+		kv := strings.SplitN(element, "=", 2)
+		if len(kv) < 2 {
+			continue
+		}
+		val := strings.Trim(kv[1], "\"")
+		switch strings.ToLower(kv[0]) {
+		case "ts":
+			ts = val
+		case "tsm":
+			tsm = val
+		}
+	}
+	if ts == "" || tsm == "" {
+		return ErrInvalidSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if !compareBase64Macs(expected, tsm) {
+		return ErrInvalidSignature
+	}
+
+	serverUnix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	self.mu.Lock()
+	self.offset = time.Unix(serverUnix, 0).Sub(time.Now().UTC())
+	self.mu.Unlock()
+	return nil
+}
+
+// Now returns the local time compensated by the learned server offset.
+func (self *ClockSkew) Now() time.Time {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return time.Now().UTC().Add(self.offset)
+}
@@ -3,7 +3,7 @@ package wmf
 import (
 	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -14,16 +14,29 @@ import (
 	"time"
 )
 
-// minimal HAWK for now (e.g. no bewit because IAGNI)
-
 var ErrNoAuth = errors.New("No Authorization Header")
 var ErrNotHawkAuth = errors.New("Not a Hawk Authorization Header")
 var ErrInvalidSignature = errors.New("Header does not match signature")
+var ErrReplayedRequest = errors.New("Nonce already used")
+var ErrStaleTimestamp = errors.New("Timestamp outside allowed skew")
+
+// defaultNonceSkew is how long a (id, ts, nonce) triple is remembered for
+// replay detection. It should be at least as large as the timestamp skew
+// callers are willing to tolerate.
+const defaultNonceSkew = 60 * time.Second
 
 type Hawk struct {
-	logger    *util.HekaLogger
-	config    util.JsMap
-	header    string
+	logger *util.HekaLogger
+	config util.JsMap
+	header string
+	// NonceCache tracks (id, ts, nonce) triples already seen so a valid
+	// header can't be replayed within the skew window. Defaults to an
+	// in-memory store; set to a shared implementation (Redis, memcache,
+	// ...) to share replay state across wmf instances.
+	NonceCache NonceStore
+	// Clock, if set, compensates outgoing request timestamps for a
+	// learned server/client clock offset (see ClockSkew).
+	Clock     *ClockSkew
 	Id        string
 	Time      string
 	Nonce     string
@@ -34,6 +47,12 @@ type Hawk struct {
 	Extra     string
 	Hash      string
 	Signature string
+	// Algorithm selects the hash used for both the payload hash and the
+	// header mac ("sha256" or "sha512"); empty defaults to sha256.
+	Algorithm string
+	// DeriveKey, if set, signs with an HKDF-SHA256 subkey derived from the
+	// shared secret instead of the secret itself -- see macKey.
+	DeriveKey bool
 }
 
 // Generate a nonce l bytes long (if l == 0, 6 bytes)
@@ -51,12 +70,17 @@ func (self *Hawk) AsHeader(req *http.Request, id, body, extra, secret string) st
 	if self.Signature == "" {
 		self.GenerateSignature(req, extra, body, secret)
 	}
-	return fmt.Sprintf("Hawk id=\"%s\", ts=\"%s\", nonce=\"%s\" ext=\"%s\", hash=\"%s\" mac=\"%s\"",
+	algorithm := self.Algorithm
+	if algorithm == "" {
+		algorithm = "sha256"
+	}
+	return fmt.Sprintf("Hawk id=\"%s\", ts=\"%s\", nonce=\"%s\", ext=\"%s\", hash=\"%s\", algorithm=\"%s\", mac=\"%s\"",
 		id,
 		self.Time,
 		self.Nonce,
 		self.Extra,
 		self.Hash,
+		algorithm,
 		self.Signature)
 }
 
@@ -72,6 +96,15 @@ func getFullPath(req *http.Request) (path string) {
 	return path
 }
 
+// macNormalizedString builds the newline-delimited string that gets HMAC'd
+// to produce a Hawk mac, shared by the header, bewit, and server-auth
+// flows -- they differ only in the localtype tag and in which fields are
+// populated (e.g. a bewit's nonce is always empty).
+func macNormalizedString(localtype, ts, nonce, method, path, host, port, hash, extra string) string {
+	return fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n",
+		localtype, ts, nonce, method, path, host, port, hash, extra)
+}
+
 // get the host and port from the request
 func (self *Hawk) getHostPort(req *http.Request) (host, port string) {
 
@@ -94,31 +127,18 @@ func (self *Hawk) getHostPort(req *http.Request) (host, port string) {
 	return host, port
 }
 
+// genHash is a thin wrapper around genHashStream for callers that already
+// have the whole body in memory as a string.
 func (self *Hawk) genHash(req *http.Request, body string) (hash string) {
-	contentType := req.Header.Get("Content-Type")
-	if contentType == "" {
-		contentType = "text/plain"
-	}
-	// Something is appending the chartype to the content. this can throw off
-	// the hash generator.
-	// Client creates mac using "application/json",
-	// we get "application/json;charset=UTF8" which brings much sadness.
-	contentType = (strings.Split(contentType, ";"))[0]
-	nbody := strings.Replace(body, "\\", "\\\\", -1)
-	nbody = strings.Replace(nbody, "\n", "\\n", -1)
-	marshalStr := fmt.Sprintf("%s\n%s\n%s\n",
-		"hawk.1.payload",
-		contentType,
-		nbody)
-	sha := sha256.Sum256([]byte(marshalStr))
-	hash = base64.StdEncoding.EncodeToString([]byte(sha[:32]))
+	hash, err := self.genHashStream(req.Header.Get("Content-Type"), strings.NewReader(body))
+	if err != nil {
+		// strings.Reader never fails a read, so this can't happen.
+		return ""
+	}
 	if util.MzGetFlag(self.config, "hawk.show_hash") {
-		self.logger.Debug("hawk", "genHash",
-			util.Fields{"marshalStr": marshalStr,
-				"hash": hash})
+		self.logger.Debug("hawk", "genHash", util.Fields{"hash": hash})
 	}
 	return hash
-
 }
 
 // Initialize self from request, extra and secret
@@ -140,7 +160,11 @@ func (self *Hawk) GenerateSignature(req *http.Request, extra, body, secret strin
 		self.Nonce = GenNonce(6)
 	}
 	if self.Time == "" {
-		self.Time = strconv.FormatInt(time.Now().UTC().Unix(), 10)
+		now := time.Now().UTC()
+		if self.Clock != nil {
+			now = self.Clock.Now()
+		}
+		self.Time = strconv.FormatInt(now.Unix(), 10)
 	}
 	if self.Method == "" {
 		self.Method = strings.ToUpper(req.Method)
@@ -149,23 +173,16 @@ func (self *Hawk) GenerateSignature(req *http.Request, extra, body, secret strin
 		self.Hash = self.genHash(req, body)
 	}
 
-	marshalStr := fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n",
-		"hawk.1.header",
-		self.Time,
-		self.Nonce,
-		strings.ToUpper(self.Method),
-		self.Path,
-		strings.ToLower(self.Host),
-		self.Port,
-		self.Hash,
-		extra)
+	marshalStr := macNormalizedString("hawk.1.header", self.Time, self.Nonce,
+		strings.ToUpper(self.Method), self.Path, strings.ToLower(self.Host),
+		self.Port, self.Hash, extra)
 
 	if util.MzGetFlag(self.config, "hawk.show_hash") {
 		self.logger.Debug("hawk", "Marshal",
 			util.Fields{"marshalStr": marshalStr,
 				"secret": secret})
 	}
-	mac := hmac.New(sha256.New, []byte(secret))
+	mac := hmac.New(self.hashFunc(), self.macKey(secret))
 	mac.Write([]byte(marshalStr))
 	self.Signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
 	return err
@@ -199,6 +216,8 @@ func (self *Hawk) ParseAuthHeader(req *http.Request, logger *util.HekaLogger) (e
 			self.Extra = val
 		case "hash":
 			self.Hash = val
+		case "algorithm":
+			self.Algorithm = val
 		case "mac":
 			self.Signature = val
 		}
@@ -208,8 +227,94 @@ func (self *Hawk) ParseAuthHeader(req *http.Request, logger *util.HekaLogger) (e
 	return err
 }
 
-// Compare a signature value against the generated Signature.
+// Compare a signature value against the generated Signature in
+// constant time. Both sides are decoded from base64 first so that
+// differing padding (e.g. a client that trims "=" characters) doesn't
+// produce a false mismatch.
 func (self *Hawk) Compare(sig string) bool {
-	// This should probably decode to byte array and compare.
-	return strings.TrimRight(sig, "=") == strings.TrimRight(self.Signature, "=")
+	return compareBase64Macs(sig, self.Signature)
+}
+
+// compareBase64Macs constant-time compares two base64-encoded macs,
+// restoring padding first. Used for both request and response
+// (Server-Authorization) signatures.
+func compareBase64Macs(a, b string) bool {
+	da, err := base64.StdEncoding.DecodeString(padBase64(a))
+	if err != nil {
+		return false
+	}
+	db, err := base64.StdEncoding.DecodeString(padBase64(b))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(da, db) == 1
+}
+
+// padBase64 restores the "=" padding base64.StdEncoding expects, in case
+// a client stripped it.
+func padBase64(s string) string {
+	if n := len(s) % 4; n != 0 {
+		s += strings.Repeat("=", 4-n)
+	}
+	return s
+}
+
+// checkTimestamp reports whether self.Time is within defaultNonceSkew of
+// the current time. The nonce cache alone only blocks replay while its
+// entry is still cached; once that entry is evicted a captured header
+// would otherwise verify again, so ts staleness has to be checked too.
+func (self *Hawk) checkTimestamp() bool {
+	ts, err := strconv.ParseInt(self.Time, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := time.Now().UTC().Unix() - ts
+	if skew < 0 {
+		skew = -skew
+	}
+	return time.Duration(skew)*time.Second <= defaultNonceSkew
+}
+
+// CheckReplay reports whether this request's (Id, Time, Nonce) triple has
+// already been used within the replay skew window, recording it if not.
+// Call this only after the signature has otherwise validated -- server-side
+// Hawk without replay protection is basically useless, since a captured
+// valid header could otherwise be resubmitted forever.
+func (self *Hawk) CheckReplay() bool {
+	if self.NonceCache == nil {
+		self.NonceCache = NewMemNonceStore(defaultNonceSkew)
+	}
+	return self.NonceCache.Seen(self.Id, self.Time, self.Nonce)
+}
+
+// Authenticate implements Auth: it parses req's Hawk header, looks up the
+// claimed id's secret via secretForId, and verifies the payload hash, mac
+// and replay status. It returns self.Id on success.
+func (self *Hawk) Authenticate(req *http.Request, body string, secretForId func(id string) (string, error)) (id string, err error) {
+	if err = self.ParseAuthHeader(req, self.logger); err != nil {
+		return "", err
+	}
+	secret, err := secretForId(self.Id)
+	if err != nil {
+		return "", err
+	}
+	if self.Hash != "" && self.Hash != self.genHash(req, body) {
+		return "", ErrInvalidSignature
+	}
+	marshalStr := macNormalizedString("hawk.1.header", self.Time, self.Nonce,
+		strings.ToUpper(self.Method), self.Path, strings.ToLower(self.Host),
+		self.Port, self.Hash, self.Extra)
+	mac := hmac.New(self.hashFunc(), self.macKey(secret))
+	mac.Write([]byte(marshalStr))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if !self.Compare(expected) {
+		return "", ErrInvalidSignature
+	}
+	if !self.checkTimestamp() {
+		return "", ErrStaleTimestamp
+	}
+	if self.CheckReplay() {
+		return "", ErrReplayedRequest
+	}
+	return self.Id, nil
 }
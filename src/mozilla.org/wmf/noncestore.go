@@ -0,0 +1,57 @@
+package wmf
+
+import (
+	"sync"
+	"time"
+)
+
+// NonceStore tracks (id, ts, nonce) triples seen within the replay-protection
+// skew window so a Hawk header can only be used once. Deployments that run
+// more than one wmf instance behind a load balancer should plug in a shared
+// implementation (Redis, memcache, ...) instead of the in-memory default so
+// replays aren't only caught when they land on the same instance twice.
+type NonceStore interface {
+	// Seen records (id, ts, nonce) and reports whether it had already been
+	// seen within the store's TTL window.
+	Seen(id, ts, nonce string) (replayed bool)
+}
+
+// memNonceStore is the default NonceStore: an in-memory cache good for a
+// single wmf instance, or for tests. Entries older than ttl are swept out
+// lazily on each call.
+type memNonceStore struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+	ttl  time.Duration
+}
+
+// NewMemNonceStore returns a NonceStore backed by an in-memory map. ttl
+// should be at least as large as the clock-skew window callers accept
+// (the Hawk default is 60 seconds) since a nonce must be remembered for
+// at least that long to catch a replay.
+func NewMemNonceStore(ttl time.Duration) NonceStore {
+	if ttl <= 0 {
+		ttl = 60 * time.Second
+	}
+	return &memNonceStore{seen: make(map[string]time.Time), ttl: ttl}
+}
+
+func (self *memNonceStore) Seen(id, ts, nonce string) bool {
+	key := id + "." + ts + "." + nonce
+	now := time.Now()
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for k, at := range self.seen {
+		if now.Sub(at) > self.ttl {
+			delete(self.seen, k)
+		}
+	}
+
+	if _, replayed := self.seen[key]; replayed {
+		return true
+	}
+	self.seen[key] = now
+	return false
+}
@@ -0,0 +1,350 @@
+package wmf
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrNotSigV4Auth = errors.New("Not an AWS4-HMAC-SHA256 Authorization Header")
+var ErrInvalidSigV4 = errors.New("Malformed AWS SigV4 credentials")
+
+const sigv4Algorithm = "AWS4-HMAC-SHA256"
+const amzDateFormat = "20060102T150405Z"
+const amzDateStampFormat = "20060102"
+
+// Auth is satisfied by Hawk and SigV4: given a request that's already
+// carrying its Authorization (header or, for SigV4, presigned query
+// params) and a callback to look up the shared/secret key for whichever
+// id the request claims, Authenticate verifies it and returns that id.
+// A single handler middleware can hold a []Auth and try each in turn
+// rather than hard-coding Hawk.
+type Auth interface {
+	Authenticate(req *http.Request, body string, secretForId func(id string) (string, error)) (id string, err error)
+}
+
+// SigV4 implements AWS Signature Version 4 request signing and
+// verification, for deployments whose clients already carry SigV4 tooling
+// (e.g. talking to S3-compatible storage) and would rather reuse that
+// than add a second, Hawk-specific signer.
+type SigV4 struct {
+	Region  string
+	Service string
+	// NonceCache tracks (accessKey, date, signature) triples already seen,
+	// same role as Hawk.NonceCache. Defaults to an in-memory store with a
+	// 15 minute window -- AWS itself only accepts SigV4 requests within 15
+	// minutes of their timestamp, so that's the natural replay window too.
+	NonceCache NonceStore
+
+	// Populated by ParseSigV4Header/ParseSigV4Query:
+	AccessKey     string
+	Date          string
+	DateStamp     string
+	SignedHeaders []string
+	Signature     string
+	scopeRegion   string
+	scopeService  string
+}
+
+const sigv4ReplayWindow = 15 * time.Minute
+
+func hmacSum(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// deriveSigningKey implements the SigV4 key derivation chain:
+// kDate = HMAC("AWS4"+secret, dateStamp)
+// kRegion = HMAC(kDate, region)
+// kService = HMAC(kRegion, service)
+// kSigning = HMAC(kService, "aws4_request")
+func deriveSigningKey(secret, dateStamp, region, service string) []byte {
+	kDate := hmacSum([]byte("AWS4"+secret), dateStamp)
+	kRegion := hmacSum(kDate, region)
+	kService := hmacSum(kRegion, service)
+	return hmacSum(kService, "aws4_request")
+}
+
+// canonicalRequest builds the five-line (plus trailing payload hash)
+// canonical request SigV4 signs a hash of.
+func canonicalRequest(method, canonicalUri, canonicalQuery string, header http.Header, signedHeaders []string, payloadHash string) string {
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		val := header.Get(name)
+		canonicalHeaders.WriteString(strings.ToLower(name))
+		canonicalHeaders.WriteString(":")
+		canonicalHeaders.WriteString(strings.TrimSpace(val))
+		canonicalHeaders.WriteString("\n")
+	}
+	return strings.Join([]string{
+		strings.ToUpper(method),
+		canonicalUri,
+		canonicalQuery,
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// sigv4URIEncode percent-encodes s per SigV4's URI-encoding rule: only
+// unreserved characters (A-Z a-z 0-9 - _ . ~) pass through unescaped,
+// everything else is "%XX" with uppercase hex -- notably a space becomes
+// "%20", not url.QueryEscape's "+".
+func sigv4URIEncode(s string) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// canonicalQueryString builds SigV4's canonical query string: every
+// parameter is SigV4 URI-encoded and the pairs sorted by encoded key,
+// then encoded value. net/url.Values.Encode() is close but percent-
+// encodes a space as "+" rather than "%20", so it doesn't match what a
+// real AWS SDK signs. X-Amz-Signature itself is excluded, since it isn't
+// part of what it signs.
+func canonicalQueryString(values url.Values) string {
+	type pair struct{ key, val string }
+	var pairs []pair
+	for k, vs := range values {
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		ek := sigv4URIEncode(k)
+		for _, v := range vs {
+			pairs = append(pairs, pair{ek, sigv4URIEncode(v)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].key != pairs[j].key {
+			return pairs[i].key < pairs[j].key
+		}
+		return pairs[i].val < pairs[j].val
+	})
+	parts := make([]string, len(pairs))
+	for i, p := range pairs {
+		parts[i] = p.key + "=" + p.val
+	}
+	return strings.Join(parts, "&")
+}
+
+func payloadHashHex(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func (self *SigV4) scope() string {
+	return fmt.Sprintf("%s/%s/%s/aws4_request", self.DateStamp, self.scopeRegion, self.scopeService)
+}
+
+func stringToSign(date, scope, canonicalReqHash string) string {
+	return strings.Join([]string{sigv4Algorithm, date, scope, canonicalReqHash}, "\n")
+}
+
+// GenerateSigV4Signature signs req with the SigV4 algorithm using accessKey,
+// secretKey, region and service, setting req's Authorization header.
+// signedHeaders should include, at minimum, "host" and, if present,
+// "x-amz-date"; req.Header must already carry any header being signed.
+func GenerateSigV4Signature(req *http.Request, body, accessKey, secretKey, region, service string, signedHeaders []string) error {
+	now := time.Now().UTC()
+	date := now.Format(amzDateFormat)
+	dateStamp := now.Format(amzDateStampFormat)
+	req.Header.Set("X-Amz-Date", date)
+
+	sort.Strings(signedHeaders)
+	canonicalUri := req.URL.EscapedPath()
+	if canonicalUri == "" {
+		canonicalUri = "/"
+	}
+	payloadHash := payloadHashHex(body)
+	creq := canonicalRequest(req.Method, canonicalUri, canonicalQueryString(req.URL.Query()),
+		req.Header, signedHeaders, payloadHash)
+	creqHash := sha256.Sum256([]byte(creq))
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", dateStamp, region, service)
+	toSign := stringToSign(date, scope, hex.EncodeToString(creqHash[:]))
+
+	signingKey := deriveSigningKey(secretKey, dateStamp, region, service)
+	signature := hex.EncodeToString(hmacSum(signingKey, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigv4Algorithm, accessKey, scope, strings.Join(signedHeaders, ";"), signature))
+	return nil
+}
+
+// ParseSigV4Header reads an "Authorization: AWS4-HMAC-SHA256 ..." header
+// into self.
+func (self *SigV4) ParseSigV4Header(req *http.Request) error {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, sigv4Algorithm+" ") {
+		return ErrNotSigV4Auth
+	}
+	var credential, signedHeaders, signature string
+	for _, part := range strings.Split(header[len(sigv4Algorithm)+1:], ", ") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Credential":
+			credential = kv[1]
+		case "SignedHeaders":
+			signedHeaders = kv[1]
+		case "Signature":
+			signature = kv[1]
+		}
+	}
+	if credential == "" || signedHeaders == "" || signature == "" {
+		return ErrInvalidSigV4
+	}
+	if err := self.parseCredential(credential); err != nil {
+		return err
+	}
+	self.SignedHeaders = strings.Split(signedHeaders, ";")
+	self.Signature = signature
+	self.Date = req.Header.Get("X-Amz-Date")
+	return nil
+}
+
+// ParseSigV4Query reads a presigned "?X-Amz-Credential=...&X-Amz-Signature=..."
+// query string into self.
+func (self *SigV4) ParseSigV4Query(req *http.Request) error {
+	q := req.URL.Query()
+	if q.Get("X-Amz-Algorithm") != sigv4Algorithm {
+		return ErrNotSigV4Auth
+	}
+	credential := q.Get("X-Amz-Credential")
+	signedHeaders := q.Get("X-Amz-SignedHeaders")
+	signature := q.Get("X-Amz-Signature")
+	if credential == "" || signedHeaders == "" || signature == "" {
+		return ErrInvalidSigV4
+	}
+	if err := self.parseCredential(credential); err != nil {
+		return err
+	}
+	self.SignedHeaders = strings.Split(signedHeaders, ";")
+	self.Signature = signature
+	self.Date = q.Get("X-Amz-Date")
+	return nil
+}
+
+func (self *SigV4) parseCredential(credential string) error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return ErrInvalidSigV4
+	}
+	self.AccessKey = parts[0]
+	self.DateStamp = parts[1]
+	self.scopeRegion = parts[2]
+	self.scopeService = parts[3]
+	return nil
+}
+
+// checkTimestamp reports whether self.Date is within sigv4ReplayWindow of
+// the current time. Verification otherwise relies solely on the in-memory
+// replay cache, so a request replayed after its cache entry expires would
+// still verify without this check.
+func (self *SigV4) checkTimestamp() bool {
+	ts, err := time.Parse(amzDateFormat, self.Date)
+	if err != nil {
+		return false
+	}
+	skew := time.Now().UTC().Sub(ts)
+	if skew < 0 {
+		skew = -skew
+	}
+	return skew <= sigv4ReplayWindow
+}
+
+// compareHexMacs constant-time compares two hex-encoded macs/signatures,
+// the SigV4 analogue of compareBase64Macs.
+func compareHexMacs(a, b string) bool {
+	da, err := hex.DecodeString(a)
+	if err != nil {
+		return false
+	}
+	db, err := hex.DecodeString(b)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(da, db) == 1
+}
+
+// Authenticate verifies req (trying the Authorization header form first,
+// then the presigned query form), looking up the secret key for whichever
+// access key the request claims via secretForId, and checking replay
+// within the 15 minute SigV4 window. It returns the authenticated access
+// key id. self.Region/self.Service, if set, must match the request's
+// scope -- left unset, any region/service the credential claims is
+// accepted.
+func (self *SigV4) Authenticate(req *http.Request, body string, secretForId func(id string) (string, error)) (id string, err error) {
+	err = self.ParseSigV4Header(req)
+	isQuery := false
+	if err == ErrNotSigV4Auth {
+		err = self.ParseSigV4Query(req)
+		isQuery = true
+	}
+	if err != nil {
+		return "", err
+	}
+	if self.Region != "" && self.Region != self.scopeRegion {
+		return "", ErrInvalidSigV4
+	}
+	if self.Service != "" && self.Service != self.scopeService {
+		return "", ErrInvalidSigV4
+	}
+
+	secret, err := secretForId(self.AccessKey)
+	if err != nil {
+		return "", err
+	}
+
+	canonicalUri := req.URL.EscapedPath()
+	if canonicalUri == "" {
+		canonicalUri = "/"
+	}
+	query := req.URL.Query()
+	payloadHash := payloadHashHex(body)
+	if isQuery {
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+	creq := canonicalRequest(req.Method, canonicalUri, canonicalQueryString(query),
+		req.Header, self.SignedHeaders, payloadHash)
+	creqHash := sha256.Sum256([]byte(creq))
+	toSign := stringToSign(self.Date, self.scope(), hex.EncodeToString(creqHash[:]))
+
+	signingKey := deriveSigningKey(secret, self.DateStamp, self.scopeRegion, self.scopeService)
+	expected := hex.EncodeToString(hmacSum(signingKey, toSign))
+	if !compareHexMacs(expected, self.Signature) {
+		return "", ErrInvalidSignature
+	}
+
+	if !self.checkTimestamp() {
+		return "", ErrStaleTimestamp
+	}
+
+	if self.NonceCache == nil {
+		self.NonceCache = NewMemNonceStore(sigv4ReplayWindow)
+	}
+	if self.NonceCache.Seen(self.AccessKey, self.Date, self.Signature) {
+		return "", ErrReplayedRequest
+	}
+	return self.AccessKey, nil
+}
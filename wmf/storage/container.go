@@ -0,0 +1,263 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"database/sql"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/FindMyDevice/util"
+)
+
+// DatabaseErrorHandler lets callers decide whether a storage error (e.g.
+// "database is locked" on SQLite under write contention) should be
+// retried or treated as fatal. Set via Container.SetErrorHandler; a nil
+// handler means "never retry".
+type DatabaseErrorHandler func(dialect string, err error) (retry bool)
+
+// Container owns the underlying *sql.DB along with everything that needs
+// to vary by backend. sqlStore drives all of its queries through a
+// Container so the same method bodies work whether they're talking to
+// Postgres or SQLite; only the placeholder syntax and a handful of
+// dialect-specific statements (see applyDatabaseUpdates) differ.
+//
+// Modeled on whatsmeow's sqlstore.Container.
+type Container struct {
+	raw          *sql.DB
+	dialect      string
+	errorHandler DatabaseErrorHandler
+	metrics      util.Metrics
+}
+
+// NewContainer wraps an already-opened *sql.DB for the given dialect
+// ("postgres" or "sqlite").
+func NewContainer(db *sql.DB, dialect string) *Container {
+	return &Container{raw: db, dialect: dialect}
+}
+
+// SetMetrics attaches a metrics sink so Query/QueryRow/Exec/Prepare can
+// record per-call latency and error counts. Without one, calls run
+// uninstrumented.
+func (c *Container) SetMetrics(metrics util.Metrics) {
+	c.metrics = metrics
+}
+
+// callerLabel walks one frame up from the Container method that invoked
+// it to name the sqlStore method issuing the query, so "Could not X"
+// log lines are backed by a "db.query.<label>" timer without every call
+// site having to pass one in by hand. Failures are counted in a single
+// "db.query.error" counter shared by all labels.
+func callerLabel(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip)
+	if !ok {
+		return "unknown"
+	}
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return "unknown"
+	}
+	name := fn.Name()
+	if idx := strings.LastIndexByte(name, '.'); idx >= 0 {
+		name = name[idx+1:]
+	}
+	return name
+}
+
+func (c *Container) record(label string, start time.Time, err error) {
+	if c.metrics == nil {
+		return
+	}
+	elapsed := time.Since(start).Nanoseconds() / int64(time.Millisecond)
+	c.metrics.Timer("db.query."+label, elapsed)
+	if err != nil {
+		c.metrics.IncrementBy("db.query.error", 1)
+	}
+}
+
+// SetErrorHandler installs a DatabaseErrorHandler used by higher layers
+// that want to retry transient errors (e.g. SQLite's "database is
+// locked") instead of failing the request outright.
+func (c *Container) SetErrorHandler(handler DatabaseErrorHandler) {
+	c.errorHandler = handler
+}
+
+// ShouldRetry reports whether err should be retried per the installed
+// DatabaseErrorHandler. With no handler installed, nothing is retried.
+func (c *Container) ShouldRetry(err error) bool {
+	if c.errorHandler == nil || err == nil {
+		return false
+	}
+	return c.errorHandler(c.dialect, err)
+}
+
+// The query text throughout this package is written Postgres-first.
+// These patterns translate the handful of Postgres-only constructs it
+// relies on (now()/interval arithmetic, extract(epoch ...), to_timestamp,
+// and locking reads) into their SQLite equivalents. Every pattern here
+// corresponds to a construct actually used by a statement in this
+// package; this is not meant to be a general SQL dialect translator.
+var (
+	sqliteNowMinusInterval    = regexp.MustCompile(`now\(\)\s*-\s*interval '(\d+) seconds'`)
+	sqliteCurrentTsMinusIntvl = regexp.MustCompile(`current_timestamp\s*-\s*interval '(\d+) seconds'`)
+	sqliteNowPlusMakeInterval = regexp.MustCompile(`now\(\)\s*\+\s*make_interval\(secs\s*=>\s*(\$\d+)\)`)
+	sqliteExtractEpochCast    = regexp.MustCompile(`extract\(epoch from ([a-zA-Z0-9_.]+)\)::int`)
+	sqliteExtractEpoch        = regexp.MustCompile(`extract\(epoch from ([a-zA-Z0-9_.]+)\)`)
+	sqliteToTimestamp         = regexp.MustCompile(`to_timestamp\((\$\d+)\)`)
+	sqliteForUpdateSkipLocked = regexp.MustCompile(`\s*for update skip locked`)
+	sqliteBareNow             = regexp.MustCompile(`\bnow\(\)`)
+)
+
+// translateDialect rewrites the Postgres-only constructs above into their
+// SQLite equivalents. It runs before placeholder rewriting, so the
+// patterns above still see "$1"-style placeholders. No-op for postgres.
+func (c *Container) translateDialect(statement string) string {
+	if c.dialect != "sqlite" {
+		return statement
+	}
+	statement = sqliteNowMinusInterval.ReplaceAllString(statement, `datetime('now', '-$1 seconds')`)
+	statement = sqliteCurrentTsMinusIntvl.ReplaceAllString(statement, `datetime('now', '-$1 seconds')`)
+	statement = sqliteNowPlusMakeInterval.ReplaceAllString(statement, `datetime('now', '+' || $1 || ' seconds')`)
+	statement = sqliteExtractEpochCast.ReplaceAllString(statement, `CAST(strftime('%s', $1) AS INTEGER)`)
+	statement = sqliteExtractEpoch.ReplaceAllString(statement, `strftime('%s', $1)`)
+	statement = sqliteToTimestamp.ReplaceAllString(statement, `datetime($1, 'unixepoch')`)
+	statement = sqliteForUpdateSkipLocked.ReplaceAllString(statement, "")
+	statement = sqliteBareNow.ReplaceAllString(statement, `datetime('now')`)
+	return statement
+}
+
+// rewrite converts Postgres-style "$1", "$2", ... placeholders to the
+// target dialect's placeholder syntax, after translating any
+// dialect-specific SQL constructs (see translateDialect). Postgres
+// statements pass through unchanged; everything else gets SQLite's
+// numbered "?NNN" form, so "$2" becomes "?2" and a statement that uses
+// its placeholders out of order or more than once still binds the same
+// arguments.
+func (c *Container) rewrite(statement string) string {
+	if c.dialect == "postgres" {
+		return statement
+	}
+	statement = c.translateDialect(statement)
+	var out strings.Builder
+	for i := 0; i < len(statement); i++ {
+		ch := statement[i]
+		if ch == '$' {
+			j := i + 1
+			for j < len(statement) && statement[j] >= '0' && statement[j] <= '9' {
+				j++
+			}
+			if j > i+1 {
+				out.WriteByte('?')
+				out.WriteString(statement[i+1 : j])
+				i = j - 1
+				continue
+			}
+		}
+		out.WriteByte(ch)
+	}
+	return out.String()
+}
+
+func (c *Container) Query(statement string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := c.raw.Query(c.rewrite(statement), args...)
+	c.record(callerLabel(2), start, err)
+	return rows, err
+}
+
+func (c *Container) QueryRow(statement string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := c.raw.QueryRow(c.rewrite(statement), args...)
+	c.record(callerLabel(2), start, nil)
+	return row
+}
+
+func (c *Container) Exec(statement string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	res, err := c.raw.Exec(c.rewrite(statement), args...)
+	c.record(callerLabel(2), start, err)
+	return res, err
+}
+
+func (c *Container) Prepare(statement string) (*sql.Stmt, error) {
+	start := time.Now()
+	stmt, err := c.raw.Prepare(c.rewrite(statement))
+	c.record(callerLabel(2), start, err)
+	return stmt, err
+}
+
+// Tx wraps a *sql.Tx so statements issued inside a transaction still go
+// through the same placeholder/dialect rewriting as Container's own
+// Query/QueryRow/Exec -- without it, a caller holding a raw *sql.Tx would
+// bypass translateDialect and send Postgres-only SQL straight to SQLite.
+type Tx struct {
+	raw *sql.Tx
+	c   *Container
+}
+
+func (t *Tx) Query(statement string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := t.raw.Query(t.c.rewrite(statement), args...)
+	t.c.record(callerLabel(2), start, err)
+	return rows, err
+}
+
+func (t *Tx) QueryRow(statement string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := t.raw.QueryRow(t.c.rewrite(statement), args...)
+	t.c.record(callerLabel(2), start, nil)
+	return row
+}
+
+func (t *Tx) Exec(statement string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	res, err := t.raw.Exec(t.c.rewrite(statement), args...)
+	t.c.record(callerLabel(2), start, err)
+	return res, err
+}
+
+func (t *Tx) Commit() error {
+	return t.raw.Commit()
+}
+
+func (t *Tx) Rollback() error {
+	return t.raw.Rollback()
+}
+
+// Begin starts a transaction whose Query/QueryRow/Exec methods rewrite
+// statements the same way Container's do (see Tx).
+func (c *Container) Begin() (*Tx, error) {
+	raw, err := c.raw.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{raw: raw, c: c}, nil
+}
+
+func (c *Container) Ping() error {
+	return c.raw.Ping()
+}
+
+func (c *Container) SetMaxOpenConns(n int) {
+	c.raw.SetMaxOpenConns(n)
+}
+
+func (c *Container) SetMaxIdleConns(n int) {
+	c.raw.SetMaxIdleConns(n)
+}
+
+func (c *Container) SetConnMaxLifetime(d time.Duration) {
+	c.raw.SetConnMaxLifetime(d)
+}
+
+func (c *Container) Stats() sql.DBStats {
+	return c.raw.Stats()
+}
+
+func (c *Container) Close() error {
+	return c.raw.Close()
+}
@@ -0,0 +1,218 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mozilla-services/FindMyDevice/util"
+)
+
+// Anything that can be killed, can be overkilled.
+
+const nonceKeyPrefix = "nonce.hmac_key.v"
+const nonceGcInterval = 1 * time.Minute
+const nonceExpiry = 5 * time.Minute
+
+// nonceKeys tracks the ordered set of server-wide HMAC keys used to sign
+// nonces, so an old key can keep verifying in-flight nonces for a while
+// after a newer one takes over signing.
+type nonceKeys struct {
+	mu     sync.RWMutex
+	byVer  map[int][]byte
+	newest int
+}
+
+// nonceKeyring lazily loads (or creates) the signing keys the first time
+// they're needed, then caches them for the life of the sqlStore.
+func (self *sqlStore) nonceKeyring() (*nonceKeys, error) {
+	self.nonceKeysOnce.Do(func() {
+		self.nonceKeysVal, self.nonceKeysErr = self.loadNonceKeys()
+	})
+	return self.nonceKeysVal, self.nonceKeysErr
+}
+
+func (self *sqlStore) loadNonceKeys() (*nonceKeys, error) {
+	keys := &nonceKeys{byVer: make(map[int][]byte)}
+	// keys are stored one per meta row, versioned from 1 up until a
+	// missing version is hit.
+	for v := 1; ; v++ {
+		metaKey := nonceKeyPrefix + strconv.Itoa(v)
+		encoded, err := self.getMeta(metaKey)
+		if err != nil {
+			return nil, err
+		}
+		if encoded == "" {
+			break
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		keys.byVer[v] = raw
+		keys.newest = v
+	}
+	if keys.newest == 0 {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		metaKey := nonceKeyPrefix + "1"
+		if err := self.setMeta(metaKey, base64.StdEncoding.EncodeToString(raw)); err != nil {
+			return nil, err
+		}
+		keys.byVer[1] = raw
+		keys.newest = 1
+		self.logger.Info(self.logCat, "Generated new nonce signing key",
+			util.Fields{"version": 1})
+	}
+	return keys, nil
+}
+
+func (k *nonceKeys) newestKey() (int, []byte) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.newest, k.byVer[k.newest]
+}
+
+func (k *nonceKeys) keyFor(version int) ([]byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.byVer[version]
+	return key, ok
+}
+
+func genSig(key []byte, val string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(val))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Generate a nonce for OAuth checks. The returned token is
+// "key.version.sig" -- the version names which server key signed it, so
+// CheckNonce doesn't have to brute-force every accepted key.
+func (self *sqlStore) GetNonce() (string, error) {
+	dbh := self.db
+
+	keys, err := self.nonceKeyring()
+	if err != nil {
+		return "", err
+	}
+	version, key := keys.newestKey()
+
+	nonceKey, _ := util.GenUUID4()
+	val, _ := util.GenUUID4()
+	statement := "insert into nonce (key, val, time) values ($1, $2, current_timestamp);"
+	if _, err := dbh.Exec(statement, nonceKey, val); err != nil {
+		return "", err
+	}
+	sig := genSig(key, nonceKey+"."+val)
+	return fmt.Sprintf("%s.%d.%s", nonceKey, version, sig), nil
+}
+
+// CheckNonce reports whether nonce matches a previously issued, unexpired
+// value. It accepts both the current three-field "key.version.sig" format
+// and, for nonces issued before a rotation finished propagating, a bare
+// two-field "key.sig" -- in which case every accepted key is tried in
+// turn. Comparison is constant-time via hmac.Equal.
+func (self *sqlStore) CheckNonce(nonce string) (bool, error) {
+	dbh := self.db
+
+	keys, err := self.nonceKeyring()
+	if err != nil {
+		return false, err
+	}
+
+	parts := strings.SplitN(nonce, ".", 3)
+	if len(parts) < 2 {
+		self.logger.Warn(self.logCat,
+			"Invalid nonce",
+			util.Fields{"nonce": nonce})
+		return false, nil
+	}
+	nonceKey := parts[0]
+	var version int
+	var sig string
+	if len(parts) == 3 {
+		version, _ = strconv.Atoi(parts[1])
+		sig = parts[2]
+	} else {
+		sig = parts[1]
+	}
+
+	statement := "select val from nonce where key = $1 limit 1;"
+	rows, err := dbh.Query(statement, nonceKey)
+	if err != nil {
+		self.logger.Error(self.logCat,
+			"Nonce check error",
+			util.Fields{"error": err.Error()})
+		return false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return false, nil
+	}
+	var val string
+	if err = rows.Scan(&val); err != nil {
+		self.logger.Error(self.logCat,
+			"Nonce check error",
+			util.Fields{"error": err.Error()})
+		return false, err
+	}
+	dbh.Exec("delete from nonce where key = $1;", nonceKey)
+
+	expected := nonceKey + "." + val
+	if key, ok := keys.keyFor(version); ok {
+		if hmac.Equal([]byte(genSig(key, expected)), []byte(sig)) {
+			return true, nil
+		}
+	}
+	// Fall back to trying every accepted key, oldest format or a rotation
+	// in progress.
+	for v, key := range keys.allKeys() {
+		if v == version {
+			continue
+		}
+		if hmac.Equal([]byte(genSig(key, expected)), []byte(sig)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (k *nonceKeys) allKeys() map[int][]byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	out := make(map[int][]byte, len(k.byVer))
+	for v, key := range k.byVer {
+		out[v] = key
+	}
+	return out
+}
+
+// startNonceGC runs the 5-minute nonce expiry sweep off a ticker instead
+// of on every CheckNonce call.
+func (self *sqlStore) startNonceGC() {
+	go func() {
+		ticker := time.NewTicker(nonceGcInterval)
+		for range ticker.C {
+			statement := fmt.Sprintf("delete from nonce where time < current_timestamp - interval '%d seconds';",
+				int64(nonceExpiry.Seconds()))
+			if _, err := self.db.Exec(statement); err != nil {
+				self.logger.Error(self.logCat, "Nonce gc error",
+					util.Fields{"error": err.Error()})
+			}
+		}
+	}()
+}
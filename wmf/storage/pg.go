@@ -7,22 +7,19 @@ package storage
 import (
 	"github.com/mozilla-services/FindMyDevice/util"
 
-	"crypto/md5"
 	"database/sql"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
 )
 
 // Storage abstration
-type pgStore struct {
+type sqlStore struct {
 	config   *util.MzConfig
 	logger   util.Logger
 	metrics  util.Metrics
@@ -30,7 +27,13 @@ type pgStore struct {
 	logCat   string
 	defExpry int64
 	maxDev   int64
-	db       *sql.DB
+	db       *Container
+	// events carries DeviceEvents published by the stale device worker.
+	events chan DeviceEvent
+	// nonce signing keys, loaded from the meta table on first use.
+	nonceKeysOnce sync.Once
+	nonceKeysVal  *nonceKeys
+	nonceKeysErr  error
 }
 
 /* Relative:
@@ -40,9 +43,11 @@ type pgStore struct {
        deviceId UUID
 
    table pendingCommands:
-       deviceId UUID index
-       time     timeStamp
-       cmd      string
+       deviceId   UUID index
+       time       timeStamp
+       cmd        string
+       leased_at  timestamptz (null until GetPending hands the row out)
+       lease_token uuid
 
    table deviceInfo:
        deviceId       UUID index
@@ -67,6 +72,16 @@ type pgStore struct {
    table meta:
        key        string
        value      string
+
+   table retention_policies:
+       scope      string index (deviceId or userId)
+       policy     bytea (gob-encoded RetentionPolicy)
+
+   table stale_devices:
+       deviceId   UUID index
+       reason     string
+       marked_at  timestamptz
+       attempts   int
 */
 /* key:
 deviceId {positions:[{lat:float, lon: float, alt: float, time:int},...],
@@ -101,7 +116,7 @@ func OpenPostgres(config *util.MzConfig, logger util.Logger, metrics util.Metric
 		defExpry = 432000
 	}
 
-	if err = applyPostgresUpdates(config); err != nil {
+	if err = applyDatabaseUpdates(config, "postgres"); err != nil {
 		return nil, err
 	}
 
@@ -109,7 +124,21 @@ func OpenPostgres(config *util.MzConfig, logger util.Logger, metrics util.Metric
 	if err != nil {
 		panic("Storage is unavailable: " + err.Error() + "\n")
 	}
-	db.SetMaxIdleConns(100)
+	maxOpenConns, err := strconv.Atoi(config.Get("db.max_open_conns", "100"))
+	if err != nil {
+		maxOpenConns = 100
+	}
+	maxIdleConns, err := strconv.Atoi(config.Get("db.max_idle_conns", "100"))
+	if err != nil {
+		maxIdleConns = 100
+	}
+	connMaxLifetime, err := strconv.ParseInt(config.Get("db.conn_max_lifetime", "3600"), 0, 64)
+	if err != nil {
+		connMaxLifetime = 3600
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(connMaxLifetime) * time.Second)
 	if err = db.Ping(); err != nil {
 		return nil, err
 	}
@@ -117,8 +146,19 @@ func OpenPostgres(config *util.MzConfig, logger util.Logger, metrics util.Metric
 	if err != nil {
 		maxDev = 1
 	}
+	numStaleWorkers, err := strconv.Atoi(config.Get("db.stale_workers", "2"))
+	if err != nil {
+		numStaleWorkers = 2
+	}
+	staleMaxAttempts, err := strconv.Atoi(config.Get("db.stale_max_attempts", "5"))
+	if err != nil {
+		staleMaxAttempts = 5
+	}
 
-	return &pgStore{
+	container := NewContainer(db, "postgres")
+	container.SetMetrics(metrics)
+
+	store := &sqlStore{
 		config:   config,
 		logger:   logger,
 		logCat:   logCat,
@@ -126,10 +166,47 @@ func OpenPostgres(config *util.MzConfig, logger util.Logger, metrics util.Metric
 		maxDev:   maxDev,
 		metrics:  metrics,
 		dsn:      dsn,
-		db:       db}, nil
+		db:       container,
+		events:   make(chan DeviceEvent, 100)}
+	store.startStaleWorkers(numStaleWorkers, staleMaxAttempts, nil)
+	store.startNonceGC()
+	store.startPoolStatsReporter()
+	return store, nil
 }
 
-func applyPostgresUpdates(config *util.MzConfig) error {
+// startPoolStatsReporter periodically publishes sql.DBStats so operators
+// can alarm on connection pool saturation instead of only seeing the
+// "Could not X" symptoms it causes downstream.
+//
+// OpenConnections/InUse/Idle are point-in-time gauges, published as-is
+// each tick. WaitCount/WaitDuration are already cumulative totals since
+// the pool was opened, so those are published as the delta since the
+// previous tick instead of the running total.
+func (self *sqlStore) startPoolStatsReporter() {
+	if self.metrics == nil {
+		return
+	}
+	go func() {
+		var lastWaitCount int64
+		var lastWaitDuration time.Duration
+		ticker := time.NewTicker(10 * time.Second)
+		for range ticker.C {
+			stats := self.db.Stats()
+			self.metrics.Gauge("db.pool.open_connections", stats.OpenConnections)
+			self.metrics.Gauge("db.pool.in_use", stats.InUse)
+			self.metrics.Gauge("db.pool.idle", stats.Idle)
+			self.metrics.IncrementBy("db.pool.wait_count", int(stats.WaitCount-lastWaitCount))
+			self.metrics.IncrementBy("db.pool.wait_duration_ms", int((stats.WaitDuration-lastWaitDuration).Milliseconds()))
+			lastWaitCount = stats.WaitCount
+			lastWaitDuration = stats.WaitDuration
+		}
+	}()
+}
+
+// applyDatabaseUpdates runs the DBRcs patch runner against the patch set
+// for dialect (sql/patches/postgres or sql/patches/sqlite).
+func applyDatabaseUpdates(config *util.MzConfig, dialect string) error {
+	patchDir := "sql/patches/" + dialect
 	if config.Get("ddl.create", "") != "" ||
 		config.GetFlag("ddl.upgrade") ||
 		config.Get("ddl.downgrade", "") != "" ||
@@ -142,14 +219,14 @@ func applyPostgresUpdates(config *util.MzConfig) error {
 		rcs := new(DBRcs)
 		rcs.Init(config)
 		if create := config.Get("ddl.create", ""); create != "" {
-			if _, _, err := rcs.CreateNextRev("sql/patches", create); err != nil {
+			if _, _, err := rcs.CreateNextRev(patchDir, create); err != nil {
 				log.Fatalf("Could not create a new revision: %s", err.Error())
 			}
 			return errors.New("Invalid revision")
 		}
 
 		if config.GetFlag("ddl.upgrade") {
-			err := rcs.Upgrade("sql/patches", true)
+			err := rcs.Upgrade(patchDir, true)
 			if err != nil {
 				log.Fatalf("Could not upgrade database: %s", err.Error())
 			}
@@ -157,7 +234,7 @@ func applyPostgresUpdates(config *util.MzConfig) error {
 		}
 
 		if down := config.Get("ddl.downgrade", ""); down != "" {
-			err := rcs.Downgrade("sql/patches", down)
+			err := rcs.Downgrade(patchDir, down)
 			if err != nil {
 				log.Fatalf("Could not downgrade database: %s", err.Error())
 			}
@@ -165,7 +242,7 @@ func applyPostgresUpdates(config *util.MzConfig) error {
 		}
 
 		if config.GetFlag("ddl.log") {
-			err := rcs.Changelog("sql/patches")
+			err := rcs.Changelog(patchDir)
 			if err != nil {
 				log.Fatalf("Could not get changelog: %s", err.Error())
 			}
@@ -176,7 +253,7 @@ func applyPostgresUpdates(config *util.MzConfig) error {
 }
 
 // Create the tables, indexes and other needed items.
-func (self *pgStore) Init() (err error) {
+func (self *sqlStore) Init() (err error) {
 	var statement string
 	var tmp string
 
@@ -201,11 +278,11 @@ func (self *pgStore) Init() (err error) {
 	return nil
 }
 
-func (self *pgStore) createDb() (err error) {
+func (self *sqlStore) createDb() (err error) {
 	panic("Please run the commands in sql/create_db.sql")
 }
 
-func (self *pgStore) markDb(date string) (err error) {
+func (self *sqlStore) markDb(date string) (err error) {
 	dbh := self.db
 	result, err := dbh.Exec("update meta set val=$2 where key=$1;",
 		"db.ver", date)
@@ -221,7 +298,7 @@ func (self *pgStore) markDb(date string) (err error) {
 }
 
 // Register a new device to a given userID.
-func (self *pgStore) RegisterDevice(userid string, dev *Device) (devId string, err error) {
+func (self *sqlStore) RegisterDevice(userid string, dev *Device) (devId string, err error) {
 	var deviceId string
 	dbh := self.db
 
@@ -286,7 +363,7 @@ func (self *pgStore) RegisterDevice(userid string, dev *Device) (devId string, e
 }
 
 // Return known info about a device.
-func (self *pgStore) GetDeviceInfo(devId string) (devInfo *Device, err error) {
+func (self *sqlStore) GetDeviceInfo(devId string) (devInfo *Device, err error) {
 
 	// collect the data for a given device for display
 
@@ -336,12 +413,22 @@ func (self *pgStore) GetDeviceInfo(devId string) (devInfo *Device, err error) {
 	return reply, nil
 }
 
-func (self *pgStore) GetPositions(devId string) (positions []Position, err error) {
+// GetPositions returns position history for a device, most recent first.
+// since/until bound the time range (unix seconds); pass 0 for until to mean
+// "now". limit caps the number of rows returned; a limit of 0 or less
+// returns only the most recent point.
+func (self *sqlStore) GetPositions(devId string, since, until int64, limit int) (positions []Position, err error) {
 
 	dbh := self.db
 
-	statement := "select extract(epoch from time)::int, latitude, longitude, altitude, accuracy from position where deviceid=$1 order by time limit 1;"
-	rows, err := dbh.Query(statement, devId)
+	if until == 0 {
+		until = time.Now().UTC().Unix()
+	}
+	if limit <= 0 {
+		limit = 1
+	}
+	statement := "select extract(epoch from time)::int, latitude, longitude, altitude, accuracy from position where deviceid=$1 and time >= to_timestamp($2) and time <= to_timestamp($3) order by time desc limit $4;"
+	rows, err := dbh.Query(statement, devId, since, until, limit)
 	defer rows.Close()
 	if err == nil {
 		var time int32
@@ -375,13 +462,40 @@ func (self *pgStore) GetPositions(devId string) (positions []Position, err error
 
 }
 
-// Get pending commands.
-func (self *pgStore) GetPending(devId string) (cmd, ctype string, err error) {
+// leaseTtl returns how long a GetPending lease is held before the command
+// becomes eligible for redelivery, in seconds.
+func (self *sqlStore) leaseTtl() int64 {
+	ttl, err := strconv.ParseInt(self.config.Get("cmd.lease_ttl", "60"), 0, 64)
+	if err != nil {
+		ttl = 60
+	}
+	return ttl
+}
+
+// GetPending leases the oldest pending command for devId instead of
+// deleting it outright, so a device that crashes between receiving the
+// HTTP response and acting on the command doesn't lose it: the command
+// stays invisible to other GetPending calls until either AckCommand
+// confirms it or the lease expires and GcDatabase makes it visible again.
+func (self *sqlStore) GetPending(devId string) (cmd, ctype, leaseToken string, err error) {
 	dbh := self.db
 	var created = time.Time{}
 
-	statement := "select id, cmd, type, time from pendingCommands where deviceId = $1 order by time limit 1;"
-	rows, err := dbh.Query(statement, devId)
+	leaseToken, err = util.GenUUID4()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	statement := fmt.Sprintf("update pendingCommands set leased_at=now(), lease_token=$1 where id = "+
+		"(select id from pendingCommands where deviceId=$2 and (leased_at is null or leased_at < now() - interval '%d seconds') "+
+		"order by time limit 1 for update skip locked) returning id, cmd, type, time;", self.leaseTtl())
+	rows, err := dbh.Query(statement, leaseToken, devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not lease pending command",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return "", "", "", err
+	}
 	defer rows.Close()
 	if rows.Next() {
 		var id string
@@ -390,19 +504,36 @@ func (self *pgStore) GetPending(devId string) (cmd, ctype string, err error) {
 			self.logger.Error(self.logCat, "Could not read pending command",
 				util.Fields{"error": err.Error(),
 					"deviceId": devId})
-			return "", "", err
+			return "", "", "", err
 		}
 		// Convert the date string to an int64
 		lifespan := int64(time.Now().UTC().Sub(created).Seconds())
 		self.metrics.Timer("cmd.pending", lifespan)
-		statement = "delete from pendingCommands where id = $1"
-		dbh.Exec(statement, id)
+	} else {
+		leaseToken = ""
 	}
 	self.Touch(devId)
-	return cmd, ctype, nil
+	return cmd, ctype, leaseToken, nil
+}
+
+// AckCommand deletes a leased command once the device has confirmed it
+// was received and acted on. leaseToken must match the token GetPending
+// handed out, so a redelivered command's late first ack can't delete the
+// row a second, newer lease is now responsible for.
+func (self *sqlStore) AckCommand(devId, leaseToken string) (err error) {
+	dbh := self.db
+
+	statement := "delete from pendingCommands where deviceid = $1 and lease_token = $2;"
+	if _, err = dbh.Exec(statement, devId, leaseToken); err != nil {
+		self.logger.Error(self.logCat, "Could not ack pending command",
+			util.Fields{"error": err.Error(),
+				"deviceId": devId})
+		return err
+	}
+	return nil
 }
 
-func (self *pgStore) GetUserFromDevice(deviceId string) (userId, name string, err error) {
+func (self *sqlStore) GetUserFromDevice(deviceId string) (userId, name string, err error) {
 
 	dbh := self.db
 	statement := "select userId, name from userToDeviceMap where deviceId = $1 limit 1;"
@@ -425,7 +556,7 @@ func (self *pgStore) GetUserFromDevice(deviceId string) (userId, name string, er
 }
 
 // Get all known devices for this user.
-func (self *pgStore) GetDevicesForUser(userId, oldUserId string) (devices []DeviceList, err error) {
+func (self *sqlStore) GetDevicesForUser(userId, oldUserId string) (devices []DeviceList, err error) {
 	var data []DeviceList
 
 	dbh := self.db
@@ -469,8 +600,8 @@ func (self *pgStore) GetDevicesForUser(userId, oldUserId string) (devices []Devi
 	return data, err
 }
 
-// pgStore a command into the list of pending commands for a device.
-func (self *pgStore) StoreCommand(devId, command, cType string) (err error) {
+// sqlStore a command into the list of pending commands for a device.
+func (self *sqlStore) StoreCommand(devId, command, cType string) (err error) {
 	//update device table to store command where devId = $1
 	dbh := self.db
 
@@ -504,7 +635,7 @@ func (self *pgStore) StoreCommand(devId, command, cType string) (err error) {
 	return nil
 }
 
-func (self *pgStore) SetAccessToken(devId, token string) (err error) {
+func (self *sqlStore) SetAccessToken(devId, token string) (err error) {
 	dbh := self.db
 
 	statement := "update deviceInfo set accesstoken = $1, lastexchange = now() where deviceId = $2"
@@ -520,7 +651,7 @@ func (self *pgStore) SetAccessToken(devId, token string) (err error) {
 }
 
 // Shorthand function to set the lock state for a device.
-func (self *pgStore) SetDeviceLock(devId string, state bool) (err error) {
+func (self *sqlStore) SetDeviceLock(devId string, state bool) (err error) {
 	dbh := self.db
 
 	statement := "update deviceInfo set lockable = $1, lastexchange = now()  where deviceId =$2"
@@ -536,12 +667,12 @@ func (self *pgStore) SetDeviceLock(devId string, state bool) (err error) {
 }
 
 // Add the location information to the known set for a device.
-func (self *pgStore) SetDeviceLocation(devId string, position *Position) (err error) {
+func (self *sqlStore) SetDeviceLocation(devId string, position *Position) (err error) {
 	dbh := self.db
 
-	// Only keep the latest positon (changed requirements from original design)
-	self.PurgePosition(devId)
-
+	// Positions are appended to the device's history; retention (how far
+	// back we keep, and how many points) is enforced by GcDatabase per the
+	// device's RetentionPolicy rather than here.
 	statement := "insert into position (deviceId, time, latitude, longitude, altitude, accuracy) values ($1, $2, $3, $4, $5, $6);"
 	st, err := dbh.Prepare(statement)
 	_, err = st.Exec(
@@ -561,29 +692,76 @@ func (self *pgStore) SetDeviceLocation(devId string, position *Position) (err er
 }
 
 // Remove old postion information for devices.
-// This previously removed "expired" location records. We currently only
-// retain the latest record for a user.
-func (self *pgStore) GcDatabase(devId, userId string) (err error) {
+// Walks the retention policy for devId (falling back to userId's policy,
+// then the "keep 1, expire after db.default_expry" default) and enforces
+// both the max age and max point count for that scope.
+func (self *sqlStore) GcDatabase(devId, userId string) (err error) {
 	dbh := self.db
 
-	// because prepare doesn't like single quoted vars
-	// because calling dbh.Exec() causes a lock race condition.
-	// because I didn't have enough reasons to drink.
-	// Delete old records (except the latest one) so we always have
-	// at least one position record.
-	// Added bonus: The following string causes the var replacer to
-	// get confused and toss an error, so yes, currently this uses inline
-	// replacement.
-	//	statement := fmt.Sprintf("delete from position where id in (select id from (select id, row_number() over (order by time desc) RowNumber from position where time < (now() - interval '%d seconds') ) tt where RowNumber > 1);", self.defExpry)
-	statement := fmt.Sprintf("delete from position where time < (now() - interval '%d seconds');", self.defExpry)
+	policy, err := self.getRetentionPolicy(devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not load retention policy",
+			util.Fields{"error": err.Error(), "deviceId": devId})
+		return err
+	}
+	if policy == nil {
+		policy, err = self.getRetentionPolicy(userId)
+		if err != nil {
+			self.logger.Error(self.logCat, "Could not load retention policy",
+				util.Fields{"error": err.Error(), "userId": userId})
+			return err
+		}
+	}
+	if policy == nil {
+		policy = &RetentionPolicy{Duration: time.Duration(self.defExpry) * time.Second, MaxPoints: 1}
+	}
+
+	// Drop points older than the policy's duration.
+	statement := fmt.Sprintf("delete from position where deviceid=$1 and time < (now() - interval '%d seconds');",
+		int64(policy.Duration.Seconds()))
 	st, err := dbh.Prepare(statement)
-	_, err = st.Exec()
+	if err != nil {
+		self.logger.Error(self.logCat, "Error gc'ing positions",
+			util.Fields{"error": err.Error()})
+		return err
+	}
+	aged, err := st.Exec(devId)
 	st.Close()
 	if err != nil {
 		self.logger.Error(self.logCat, "Error gc'ing positions",
 			util.Fields{"error": err.Error()})
 		return err
 	}
+
+	// Keep at most MaxPoints, oldest first to go. If Stride > 1, the points
+	// beyond MaxPoints aren't simply dropped: every Stride'th one is kept as
+	// a down-sampled tail of history instead of losing it outright.
+	var capped sql.Result
+	if policy.MaxPoints > 0 {
+		if policy.Stride > 1 {
+			statement = "delete from position where id in (select id from (select id, row_number() over (order by time desc) RowNumber from position where deviceid=$1) tt where RowNumber > $2 and (RowNumber - $2 - 1) % $3 != 0);"
+			capped, err = dbh.Exec(statement, devId, policy.MaxPoints, policy.Stride)
+		} else {
+			statement = "delete from position where id in (select id from (select id, row_number() over (order by time desc) RowNumber from position where deviceid=$1) tt where RowNumber > $2);"
+			capped, err = dbh.Exec(statement, devId, policy.MaxPoints)
+		}
+		if err != nil {
+			self.logger.Error(self.logCat, "Error gc'ing positions",
+				util.Fields{"error": err.Error()})
+			return err
+		}
+	}
+
+	if self.metrics != nil {
+		if cnt, cerr := aged.RowsAffected(); cerr == nil {
+			self.metrics.IncrementBy("storage.gc.position.expired", int(cnt))
+		}
+		if capped != nil {
+			if cnt, cerr := capped.RowsAffected(); cerr == nil {
+				self.metrics.IncrementBy("storage.gc.position.capped", int(cnt))
+			}
+		}
+	}
 	// TODO: convert the following into statements
 	/*
 	   // remove "extra" devices registered to the user
@@ -599,11 +777,28 @@ func (self *pgStore) GcDatabase(devId, userId string) (err error) {
 	        deviceinfo.deviceid where usertodevicemap.deviceid is null);
 	*/
 
+	// Expire leases that were handed out by GetPending but never acked,
+	// so the command becomes visible for redelivery.
+	statement = fmt.Sprintf("update pendingCommands set leased_at=null, lease_token=null "+
+		"where deviceid=$1 and leased_at is not null and leased_at < now() - interval '%d seconds';",
+		self.leaseTtl())
+	redelivered, err := dbh.Exec(statement, devId)
+	if err != nil {
+		self.logger.Error(self.logCat, "Error expiring command leases",
+			util.Fields{"error": err.Error()})
+		return err
+	}
+	if self.metrics != nil {
+		if cnt, cerr := redelivered.RowsAffected(); cerr == nil && cnt > 0 {
+			self.metrics.IncrementBy("cmd.redelivered", int(cnt))
+		}
+	}
+
 	return nil
 }
 
 // remove all tracking information for devId.
-func (self *pgStore) PurgePosition(devId string) (err error) {
+func (self *sqlStore) PurgePosition(devId string) (err error) {
 	dbh := self.db
 
 	statement := "delete from position where deviceid = $1;"
@@ -613,7 +808,7 @@ func (self *pgStore) PurgePosition(devId string) (err error) {
 	return nil
 }
 
-func (self *pgStore) Touch(devId string) (err error) {
+func (self *sqlStore) Touch(devId string) (err error) {
 	dbh := self.db
 
 	statement := "update deviceInfo set lastexchange = now() where deviceid = $1"
@@ -625,7 +820,7 @@ func (self *pgStore) Touch(devId string) (err error) {
 	return nil
 }
 
-func (self *pgStore) DeleteDevice(devId string) (err error) {
+func (self *sqlStore) DeleteDevice(devId string) (err error) {
 	dbh := self.db
 
 	var tables = []string{"pendingcommands",
@@ -649,7 +844,7 @@ func (self *pgStore) DeleteDevice(devId string) (err error) {
 	return nil
 }
 
-func (self *pgStore) PurgeCommands(devId string) (err error) {
+func (self *sqlStore) PurgeCommands(devId string) (err error) {
 	dbh := self.db
 
 	_, err = dbh.Exec("delete from pendingcommands where deviceid=$1;", devId)
@@ -662,7 +857,7 @@ func (self *pgStore) PurgeCommands(devId string) (err error) {
 	return err
 }
 
-func (self *pgStore) getMeta(key string) (val string, err error) {
+func (self *sqlStore) getMeta(key string) (val string, err error) {
 	var row *sql.Row
 	dbh := self.db
 
@@ -674,7 +869,7 @@ func (self *pgStore) getMeta(key string) (val string, err error) {
 	return "", err
 }
 
-func (self *pgStore) setMeta(key, val string) (err error) {
+func (self *sqlStore) setMeta(key, val string) (err error) {
 	var statement string
 	dbh := self.db
 
@@ -693,82 +888,10 @@ func (self *pgStore) setMeta(key, val string) (err error) {
 	return nil
 }
 
-func (self *pgStore) Close() {
+func (self *sqlStore) Close() {
 	self.db.Close()
 }
 
-/* Nonce handler.
-   Anything that can be killed, can be overkilled.
-*/
-
-func (self *pgStore) genSig(key, val string) string {
-	// Yes, this is using woefully insecure MD5. That's ok.
-	// Collisions should be rare enough and this is more
-	// paranoid security than is really required.
-	sig := md5.New()
-	io.WriteString(sig, key+"."+val)
-	return hex.EncodeToString(sig.Sum(nil))
-}
-
-// Generate a nonce for OAuth checks
-func (self *pgStore) GetNonce() (string, error) {
-	var statement string
-	dbh := self.db
-
-	key, _ := util.GenUUID4()
-	val, _ := util.GenUUID4()
-	statement = "insert into nonce (key, val, time) values ($1, $2, current_timestamp);"
-
-	if _, err := dbh.Exec(statement, key, val); err != nil {
-		return "", err
-	}
-	ret := key + "." + self.genSig(key, val)
-	return ret, nil
-}
-
-// Does the user's nonce match?
-func (self *pgStore) CheckNonce(nonce string) (bool, error) {
-	var statement string
-	dbh := self.db
-
-	// gc nonces before checking.
-	statement = "delete from nonce where time < current_timestamp - interval '5 minutes';"
-	dbh.Exec(statement)
-
-	keysig := strings.SplitN(nonce, ".", 2)
-	if len(keysig) != 2 {
-		self.logger.Warn(self.logCat,
-			"Invalid nonce",
-			util.Fields{"nonce": nonce})
-		return false, nil
-	}
-	statement = "select val from nonce where key = $1 limit 1;"
-	rows, err := dbh.Query(statement, keysig[0])
-	defer rows.Close()
-	if err == nil {
-		for rows.Next() {
-			var val string
-			err = rows.Scan(&val)
-			if err == nil {
-				dbh.Exec("delete from nonce where key = $1;", keysig[0])
-				sig := self.genSig(keysig[0], val)
-				return sig == keysig[1], nil
-			}
-			self.logger.Error(self.logCat,
-				"Nonce check error",
-				util.Fields{"error": err.Error()})
-			return false, err
-		}
-		// Not found
-		return false, nil
-	}
-	// An error happened.
-	self.logger.Error(self.logCat,
-		"Nonce check error",
-		util.Fields{"error": err.Error()})
-	return false, err
-}
-
 func init() {
 	AvailableStores["postgres"] = OpenPostgres
 }
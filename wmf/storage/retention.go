@@ -0,0 +1,105 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"time"
+
+	"github.com/mozilla-services/FindMyDevice/util"
+)
+
+// RetentionPolicy controls how long position history is kept for a device
+// or user, and how many points are retained. It is gob-encoded before being
+// stored so that new fields can be added later without a schema migration.
+type RetentionPolicy struct {
+	// Duration is how long a position record is kept before GcDatabase
+	// removes it.
+	Duration time.Duration
+	// MaxPoints is the maximum number of position records kept for the
+	// scope, oldest dropped first. 0 means unbounded.
+	MaxPoints int
+	// Stride, if > 1, means GcDatabase should down-sample history by
+	// keeping only every Stride'th point once MaxPoints is exceeded,
+	// rather than simply dropping the oldest.
+	Stride int
+}
+
+func marshalRetentionPolicy(policy *RetentionPolicy) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(policy); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func unmarshalRetentionPolicy(data []byte) (*RetentionPolicy, error) {
+	policy := &RetentionPolicy{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(policy); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// SetRetentionPolicy attaches a RetentionPolicy to a scope, which is either
+// a deviceId or a userId. A per-device policy takes precedence over a
+// per-user one in GcDatabase.
+func (self *sqlStore) SetRetentionPolicy(scope string, policy *RetentionPolicy) (err error) {
+	dbh := self.db
+
+	data, err := marshalRetentionPolicy(policy)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not marshal retention policy",
+			util.Fields{"error": err.Error(), "scope": scope})
+		return err
+	}
+
+	statement := "update retention_policies set policy = $2 where scope = $1;"
+	res, err := dbh.Exec(statement, scope, data)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not store retention policy",
+			util.Fields{"error": err.Error(), "scope": scope})
+		return err
+	}
+	if cnt, err := res.RowsAffected(); cnt == 0 || err != nil {
+		statement = "insert into retention_policies (scope, policy) values ($1, $2);"
+		if _, err = dbh.Exec(statement, scope, data); err != nil {
+			self.logger.Error(self.logCat, "Could not store retention policy",
+				util.Fields{"error": err.Error(), "scope": scope})
+			return err
+		}
+	}
+	return nil
+}
+
+// getRetentionPolicy returns the policy for scope, or nil if none has been
+// set (callers fall back to the next scope, then to the hard-coded default).
+func (self *sqlStore) getRetentionPolicy(scope string) (policy *RetentionPolicy, err error) {
+	if scope == "" {
+		return nil, nil
+	}
+	dbh := self.db
+
+	var data []byte
+	statement := "select policy from retention_policies where scope = $1;"
+	err = dbh.QueryRow(statement, scope).Scan(&data)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		self.logger.Error(self.logCat, "Could not fetch retention policy",
+			util.Fields{"error": err.Error(), "scope": scope})
+		return nil, err
+	}
+	policy, err = unmarshalRetentionPolicy(data)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not decode retention policy",
+			util.Fields{"error": err.Error(), "scope": scope})
+		return nil, err
+	}
+	return policy, nil
+}
@@ -0,0 +1,89 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/mozilla-services/FindMyDevice/util"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// OpenSQLite opens (and if needed creates) a SQLite-backed Storage. This
+// is meant for small deployments and for the test suite, where standing
+// up a Postgres server isn't worth it; it shares sqlStore's method set
+// with OpenPostgres by driving everything through a dialect-aware
+// Container, which rewrites placeholders and the handful of
+// Postgres-only constructs (now()/interval arithmetic, extract(epoch
+// ...), to_timestamp, FOR UPDATE SKIP LOCKED) the shared statements use
+// (see Container.translateDialect). FOR UPDATE SKIP LOCKED is simply
+// dropped for SQLite: db.SetMaxOpenConns(1) below already serializes
+// every query onto a single connection, so there's no concurrent claim
+// for it to guard against.
+func OpenSQLite(config *util.MzConfig, logger util.Logger, metrics util.Metrics) (storage Storage, err error) {
+	path := config.Get("db.path", "wmf.db")
+	dsn := fmt.Sprintf("file:%s?_foreign_keys=on", path)
+	logCat := "storage"
+
+	defExpry, err := strconv.ParseInt(config.Get("db.default_expry", "432000"), 0, 64)
+	if err != nil {
+		defExpry = 432000
+	}
+
+	if err = applyDatabaseUpdates(config, "sqlite"); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		panic("Storage is unavailable: " + err.Error() + "\n")
+	}
+	// SQLite only supports a single writer at a time; keep the pool small
+	// so callers block on that writer rather than each opening their own
+	// connection and hitting "database is locked".
+	db.SetMaxOpenConns(1)
+	if err = db.Ping(); err != nil {
+		return nil, err
+	}
+	maxDev, err := strconv.ParseInt(config.Get("db.max_devices_per_user", "1"), 0, 64)
+	if err != nil {
+		maxDev = 1
+	}
+	numStaleWorkers, err := strconv.Atoi(config.Get("db.stale_workers", "1"))
+	if err != nil {
+		numStaleWorkers = 1
+	}
+	staleMaxAttempts, err := strconv.Atoi(config.Get("db.stale_max_attempts", "5"))
+	if err != nil {
+		staleMaxAttempts = 5
+	}
+
+	container := NewContainer(db, "sqlite")
+	container.SetErrorHandler(func(dialect string, err error) bool {
+		return err != nil && err.Error() == "database is locked"
+	})
+	container.SetMetrics(metrics)
+
+	store := &sqlStore{
+		config:   config,
+		logger:   logger,
+		logCat:   logCat,
+		defExpry: defExpry,
+		maxDev:   maxDev,
+		metrics:  metrics,
+		dsn:      dsn,
+		db:       container,
+		events:   make(chan DeviceEvent, 100)}
+	store.startStaleWorkers(numStaleWorkers, staleMaxAttempts, nil)
+	store.startNonceGC()
+	return store, nil
+}
+
+func init() {
+	AvailableStores["sqlite"] = OpenSQLite
+}
@@ -0,0 +1,221 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package storage
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/mozilla-services/FindMyDevice/util"
+)
+
+// Event names emitted on a sqlStore's DeviceEvent channel once the stale
+// worker has finished with a device.
+const (
+	DeviceRefreshed = "refreshed"
+	DeviceGaveUp    = "gave_up"
+)
+
+// DeviceEvent is emitted after the stale worker attempts to refresh a
+// device that was previously marked stale.
+type DeviceEvent struct {
+	DeviceId string
+	Event    string
+}
+
+// StaleDevice is a row from the stale_devices table.
+type StaleDevice struct {
+	DeviceId string
+	Reason   string
+	MarkedAt time.Time
+	Attempts int
+}
+
+// MarkStale records that devId's pushUrl (or other device state) looked
+// bad and should be re-checked by the background worker. It is safe to
+// call repeatedly for the same device; the row is upserted.
+func (self *sqlStore) MarkStale(devId, reason string) (err error) {
+	dbh := self.db
+
+	statement := "update stale_devices set reason = $2, marked_at = now() where deviceid = $1 and attempts = 0;"
+	res, err := dbh.Exec(statement, devId, reason)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not mark device stale",
+			util.Fields{"error": err.Error(), "deviceId": devId})
+		return err
+	}
+	if cnt, err := res.RowsAffected(); cnt == 0 || err != nil {
+		statement = "insert into stale_devices (deviceid, reason, marked_at, attempts) " +
+			"values ($1, $2, now(), 0) on conflict (deviceid) do update set reason = $2, marked_at = now();"
+		if _, err = dbh.Exec(statement, devId, reason); err != nil {
+			self.logger.Error(self.logCat, "Could not mark device stale",
+				util.Fields{"error": err.Error(), "deviceId": devId})
+			return err
+		}
+	}
+	return nil
+}
+
+// ListStale returns up to limit rows due for a refresh attempt.
+func (self *sqlStore) ListStale(limit int) (devices []StaleDevice, err error) {
+	dbh := self.db
+
+	statement := "select deviceid, reason, marked_at, attempts from stale_devices where marked_at <= now() order by marked_at limit $1;"
+	rows, err := dbh.Query(statement, limit)
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not list stale devices",
+			util.Fields{"error": err.Error()})
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dev StaleDevice
+		if err = rows.Scan(&dev.DeviceId, &dev.Reason, &dev.MarkedAt, &dev.Attempts); err != nil {
+			self.logger.Error(self.logCat, "Could not read stale device row",
+				util.Fields{"error": err.Error()})
+			return nil, err
+		}
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+// ClearStale removes devId from the stale_devices table, e.g. once it has
+// been confirmed reachable again.
+func (self *sqlStore) ClearStale(devId string) (err error) {
+	dbh := self.db
+
+	if _, err = dbh.Exec("delete from stale_devices where deviceid = $1;", devId); err != nil {
+		self.logger.Error(self.logCat, "Could not clear stale device",
+			util.Fields{"error": err.Error(), "deviceId": devId})
+		return err
+	}
+	return nil
+}
+
+// Events returns the channel DeviceEvents are published on as the stale
+// worker refreshes or gives up on devices.
+func (self *sqlStore) Events() <-chan DeviceEvent {
+	return self.events
+}
+
+// startStaleWorkers launches n goroutines that drain stale_devices,
+// re-ping the device's pushUrl, and either clear the row or back it off.
+// Multiple wmf instances can run this against the same database: each
+// worker claims a row with SELECT ... FOR UPDATE SKIP LOCKED so they never
+// duplicate work.
+func (self *sqlStore) startStaleWorkers(n int, maxAttempts int, httpClient *http.Client) {
+	if n <= 0 {
+		n = 1
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	for i := 0; i < n; i++ {
+		go self.staleWorkerLoop(maxAttempts, httpClient)
+	}
+}
+
+func (self *sqlStore) staleWorkerLoop(maxAttempts int, httpClient *http.Client) {
+	for {
+		if !self.staleWorkerTick(maxAttempts, httpClient) {
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// staleWorkerTick claims and processes a single stale row. It returns
+// false if there was no work to do, so the caller can back off.
+func (self *sqlStore) staleWorkerTick(maxAttempts int, httpClient *http.Client) bool {
+	dbh := self.db
+
+	tx, err := dbh.Begin()
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not start stale worker transaction",
+			util.Fields{"error": err.Error()})
+		return false
+	}
+
+	var devId, pushUrl, reason string
+	var attempts int
+	statement := "select deviceid, reason, attempts from stale_devices where marked_at <= now() order by marked_at limit 1 for update skip locked;"
+	err = tx.QueryRow(statement).Scan(&devId, &reason, &attempts)
+	if err == sql.ErrNoRows {
+		tx.Commit()
+		return false
+	}
+	if err != nil {
+		self.logger.Error(self.logCat, "Could not claim stale device",
+			util.Fields{"error": err.Error()})
+		tx.Rollback()
+		return false
+	}
+
+	err = tx.QueryRow("select pushurl from deviceinfo where deviceid = $1;", devId).Scan(&pushUrl)
+	if err != nil && err != sql.ErrNoRows {
+		self.logger.Error(self.logCat, "Could not load pushUrl for stale device",
+			util.Fields{"error": err.Error(), "deviceId": devId})
+		tx.Rollback()
+		return false
+	}
+
+	ok := pushUrl != "" && pingPushUrl(httpClient, pushUrl)
+
+	if ok {
+		if _, err = tx.Exec("delete from stale_devices where deviceid = $1;", devId); err != nil {
+			self.logger.Error(self.logCat, "Could not clear stale device",
+				util.Fields{"error": err.Error(), "deviceId": devId})
+			tx.Rollback()
+			return false
+		}
+		tx.Commit()
+		self.emitDeviceEvent(devId, DeviceRefreshed)
+		return true
+	}
+
+	attempts++
+	if attempts > maxAttempts {
+		if _, err = tx.Exec("delete from stale_devices where deviceid = $1;", devId); err != nil {
+			self.logger.Error(self.logCat, "Could not drop gave-up stale device",
+				util.Fields{"error": err.Error(), "deviceId": devId})
+			tx.Rollback()
+			return false
+		}
+		tx.Commit()
+		self.emitDeviceEvent(devId, DeviceGaveUp)
+		return true
+	}
+
+	// exponential backoff: 1m, 2m, 4m, ...
+	backoff := time.Duration(1<<uint(attempts-1)) * time.Minute
+	statement = "update stale_devices set attempts = $2, marked_at = now() + make_interval(secs => $3) where deviceid = $1;"
+	if _, err = tx.Exec(statement, devId, attempts, int(backoff.Seconds())); err != nil {
+		self.logger.Error(self.logCat, "Could not back off stale device",
+			util.Fields{"error": err.Error(), "deviceId": devId})
+		tx.Rollback()
+		return false
+	}
+	tx.Commit()
+	return true
+}
+
+func (self *sqlStore) emitDeviceEvent(devId, event string) {
+	select {
+	case self.events <- DeviceEvent{DeviceId: devId, Event: event}:
+	default:
+		self.logger.Warn(self.logCat, "Dropped device event, no listener",
+			util.Fields{"deviceId": devId, "event": event})
+	}
+}
+
+func pingPushUrl(httpClient *http.Client, pushUrl string) bool {
+	resp, err := httpClient.Head(pushUrl)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode < 500
+}